@@ -2,9 +2,11 @@ package engine
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,16 +34,37 @@ func (e ErrNoMatchingVarSource) Error() string {
 	return fmt.Sprintf("no var source found for %s", e.VarSource)
 }
 
+// ErrPrivilegeNotAllowed is returned when a step asks to run a privileged
+// image that is not on the operator-configured escalation allowlist.
+type ErrPrivilegeNotAllowed struct {
+	ImageType  string
+	Repository string
+}
+
+func (e ErrPrivilegeNotAllowed) Error() string {
+	return fmt.Sprintf("privileged is not allowed for %s image %s", e.ImageType, e.Repository)
+}
+
+// EscalationAllowlistEntry permits a single (image type, repository) pair
+// to request privileged: true. Requests that pass the allowlist are still
+// handed to the external policy checker; requests that fail it are rejected
+// before the checker is called.
+type EscalationAllowlistEntry struct {
+	ImageType  string
+	Repository string
+}
+
 type buildStepDelegate struct {
-	build           db.Build
-	planID          atc.PlanID
-	clock           clock.Clock
-	state           exec.RunState
-	stderr          io.Writer
-	stdout          io.Writer
-	policyChecker   policy.Checker
-	globalSecrets   creds.Secrets
-	artifactSourcer worker.ArtifactSourcer
+	build               db.Build
+	planID              atc.PlanID
+	clock               clock.Clock
+	state               exec.RunState
+	stderr              io.Writer
+	stdout              io.Writer
+	policyChecker       policy.Checker
+	globalSecrets       creds.Secrets
+	artifactSourcer     worker.ArtifactSourcer
+	escalationAllowlist []EscalationAllowlistEntry
 }
 
 func NewBuildStepDelegate(
@@ -52,17 +75,19 @@ func NewBuildStepDelegate(
 	policyChecker policy.Checker,
 	globalSecrets creds.Secrets,
 	artifactSourcer worker.ArtifactSourcer,
+	escalationAllowlist []EscalationAllowlistEntry,
 ) *buildStepDelegate {
 	return &buildStepDelegate{
-		build:           build,
-		planID:          planID,
-		clock:           clock,
-		state:           state,
-		stdout:          nil,
-		stderr:          nil,
-		policyChecker:   policyChecker,
-		globalSecrets:   globalSecrets,
-		artifactSourcer: artifactSourcer,
+		build:               build,
+		planID:              planID,
+		clock:               clock,
+		state:               state,
+		stdout:              nil,
+		stderr:              nil,
+		policyChecker:       policyChecker,
+		globalSecrets:       globalSecrets,
+		artifactSourcer:     artifactSourcer,
+		escalationAllowlist: escalationAllowlist,
 	}
 }
 
@@ -221,21 +246,81 @@ func (delegate *buildStepDelegate) FetchImage(
 		return worker.ImageSpec{}, nil, err
 	}
 
+	switch getPlan.Get.PullPolicy {
+	case atc.PullPolicyNever, atc.PullPolicyIfNotPresent:
+		spec, cache, found, err := delegate.skipImageFetch(ctx, getPlan, privileged)
+		if err != nil {
+			return worker.ImageSpec{}, nil, err
+		}
+
+		if found {
+			return spec, cache, nil
+		}
+
+		if getPlan.Get.PullPolicy == atc.PullPolicyNever {
+			return worker.ImageSpec{}, nil, fmt.Errorf("pull policy is %q but no cached image was found for %s", atc.PullPolicyNever, getPlan.Get.Type)
+		}
+
+		// pull policy is "if not present": fall through to a normal fetch
+	}
+
 	// XXX: Can this not be on a child scope?
 	fetchState := delegate.state.NewScope()
 
+	imgAttrs := tracing.Attrs{
+		"image.type":       getPlan.Get.Type,
+		"image.privileged": strconv.FormatBool(privileged),
+	}
+
 	if checkPlan != nil {
-		ok, err := fetchState.Run(ctx, *checkPlan)
+		err := func() error {
+			checkCtx, checkSpan := delegate.StartSpan(ctx, "check-image", imgAttrs)
+			defer checkSpan.End()
+
+			err := delegate.build.SaveEvent(event.SubFetchImage{
+				Time: delegate.clock.Now().Unix(),
+				Origin: event.Origin{
+					ID: event.OriginID(delegate.planID),
+				},
+				PublicPlan:  checkPlan.Public(),
+				TraceParent: tracing.TraceParent(checkSpan),
+			})
+			if err != nil {
+				return fmt.Errorf("save sub fetch image event: %w", err)
+			}
+
+			ok, err := fetchState.Run(checkCtx, *checkPlan)
+			if err != nil {
+				return err
+			}
+
+			if !ok {
+				return fmt.Errorf("image check failed")
+			}
+
+			return nil
+		}()
 		if err != nil {
 			return worker.ImageSpec{}, nil, err
 		}
+	}
 
-		if !ok {
-			return worker.ImageSpec{}, nil, fmt.Errorf("image check failed")
-		}
+	getCtx, getSpan := delegate.StartSpan(ctx, "fetch-image", imgAttrs)
+	defer getSpan.End()
+
+	err = delegate.build.SaveEvent(event.SubFetchImage{
+		Time: delegate.clock.Now().Unix(),
+		Origin: event.Origin{
+			ID: event.OriginID(delegate.planID),
+		},
+		PublicPlan:  getPlan.Public(),
+		TraceParent: tracing.TraceParent(getSpan),
+	})
+	if err != nil {
+		return worker.ImageSpec{}, nil, fmt.Errorf("save sub fetch image event: %w", err)
 	}
 
-	ok, err := fetchState.Run(ctx, getPlan)
+	ok, err := fetchState.Run(getCtx, getPlan)
 	if err != nil {
 		return worker.ImageSpec{}, nil, err
 	}
@@ -270,6 +355,54 @@ func (delegate *buildStepDelegate) FetchImage(
 	}, result.ResourceCache, nil
 }
 
+// skipImageFetch looks for a resource cache already used by this
+// build's team/pipeline for the given image resource. If one exists, the
+// get plan is never run and a resource is sourced directly off the cache,
+// letting operators with `pull_policy: never` or `pull_policy: if-not-present`
+// avoid re-fetching large or air-gapped image resources. The caller decides
+// what to do when no cache is found: `never` is an error, `if-not-present`
+// falls back to a normal fetch.
+func (delegate *buildStepDelegate) skipImageFetch(
+	ctx context.Context,
+	getPlan atc.Plan,
+	privileged bool,
+) (worker.ImageSpec, db.UsedResourceCache, bool, error) {
+	cache, found, err := delegate.build.UsedResourceCacheForResource(getPlan.Get.Type, getPlan.Get.Source, getPlan.Get.VersionedResourceTypes)
+	if err != nil {
+		return worker.ImageSpec{}, nil, false, fmt.Errorf("look up cached image resource: %w", err)
+	}
+
+	if !found {
+		return worker.ImageSpec{}, nil, false, nil
+	}
+
+	err = delegate.build.SaveImageResourceVersion(cache)
+	if err != nil {
+		return worker.ImageSpec{}, nil, false, fmt.Errorf("save image version: %w", err)
+	}
+
+	source, err := delegate.artifactSourcer.SourceImageFromCache(lagerctx.FromContext(ctx), cache, privileged)
+	if err != nil {
+		return worker.ImageSpec{}, nil, false, fmt.Errorf("wire cached image: %w", err)
+	}
+
+	err = delegate.build.SaveEvent(event.ImagePullSkipped{
+		Time: delegate.clock.Now().Unix(),
+		Origin: event.Origin{
+			ID: event.OriginID(delegate.planID),
+		},
+		Type: getPlan.Get.Type,
+	})
+	if err != nil {
+		return worker.ImageSpec{}, nil, false, fmt.Errorf("save image pull skipped event: %w", err)
+	}
+
+	return worker.ImageSpec{
+		ImageArtifactSource: source,
+		Privileged:          privileged,
+	}, cache, true, nil
+}
+
 // The var source configs that are passed in will eventually be used to
 // overwrite the var source configs on the child state created for running a
 // get var substep. This is done this way so that steps can pass a modified
@@ -331,18 +464,25 @@ func (v *StepVariables) Get(ref vars.Reference) (interface{}, bool, error) {
 		},
 	}
 
+	getVarCtx, getVarSpan := v.delegate.StartSpan(v.ctx, "get-var", tracing.Attrs{
+		"var.source": ref.Source,
+		"var.path":   v.delegate.buildOutputFilter(ref.Path),
+	})
+	defer getVarSpan.End()
+
 	err = v.delegate.build.SaveEvent(event.SubGetVar{
 		Time: v.delegate.clock.Now().Unix(),
 		Origin: event.Origin{
 			ID: event.OriginID(v.delegate.planID),
 		},
-		PublicPlan: getVarPlan.Public(),
+		PublicPlan:  getVarPlan.Public(),
+		TraceParent: tracing.TraceParent(getVarSpan),
 	})
 	if err != nil {
 		return nil, false, fmt.Errorf("save sub get var event: %w", err)
 	}
 
-	ok, err = childState.Run(v.ctx, getVarPlan)
+	ok, err = childState.Run(getVarCtx, getVarPlan)
 	if err != nil {
 		return nil, false, fmt.Errorf("run sub get var: %w", err)
 	}
@@ -360,6 +500,13 @@ func (v *StepVariables) Get(ref vars.Reference) (interface{}, bool, error) {
 }
 
 func (delegate *buildStepDelegate) checkImagePolicy(imageSource atc.Source, imageType string, privileged bool) error {
+	if privileged && !delegate.escalationAllowed(imageType, imageSource) {
+		return ErrPrivilegeNotAllowed{
+			ImageType:  imageType,
+			Repository: repositoryOf(imageSource),
+		}
+	}
+
 	if !delegate.policyChecker.ShouldCheckAction(policy.ActionUseImage) {
 		return nil
 	}
@@ -392,12 +539,53 @@ func (delegate *buildStepDelegate) checkImagePolicy(imageSource atc.Source, imag
 	return nil
 }
 
+// escalationAllowed reports whether the given (imageType, repository) pair
+// may request privileged: true. An empty allowlist leaves that decision to
+// the policy checker, so this is opt-in for clusters that configure it.
+func (delegate *buildStepDelegate) escalationAllowed(imageType string, source atc.Source) bool {
+	if len(delegate.escalationAllowlist) == 0 {
+		return true
+	}
+
+	return allowlistAllows(delegate.escalationAllowlist, imageType, repositoryOf(source))
+}
+
+// allowlistAllows is the pure matching logic behind escalationAllowed,
+// split out so it can be unit tested without a full buildStepDelegate.
+func allowlistAllows(allowlist []EscalationAllowlistEntry, imageType, repository string) bool {
+	for _, entry := range allowlist {
+		if entry.ImageType == imageType && entry.Repository == repository {
+			return true
+		}
+	}
+
+	return false
+}
+
+func repositoryOf(source atc.Source) string {
+	repository, _ := source["repository"].(string)
+	return repository
+}
+
 func (delegate *buildStepDelegate) buildOutputFilter(str string) string {
-	it := &credVarsIterator{line: str}
+	it := &credVarsIterator{line: str, minLength: effectiveMinLength(delegate.state.RedactionMinLength())}
 	delegate.state.IterateInterpolatedCreds(it)
 	return it.line
 }
 
+// defaultRedactionMinLength preserves the original, unconditional
+// "don't consider a single char a secret" behavior for callers that don't
+// configure RunState.RedactionMinLength(), including the zero value a
+// Go int defaults to when nobody has set it.
+const defaultRedactionMinLength = 1
+
+func effectiveMinLength(configured int) int {
+	if configured <= 0 {
+		return defaultRedactionMinLength
+	}
+	return configured
+}
+
 func (delegate *buildStepDelegate) redactImageSource(source atc.Source) (atc.Source, error) {
 	b, err := json.Marshal(&source)
 	if err != nil {
@@ -412,16 +600,46 @@ func (delegate *buildStepDelegate) redactImageSource(source atc.Source) (atc.Sou
 	return newSource, nil
 }
 
+// credVarsIterator redacts every occurrence of a secret's value, its
+// base64-encoded form, and its JSON-string-escaped form, so that secrets
+// leaked through things like kubectl/curl output or JSON logs are still
+// caught.
 type credVarsIterator struct {
-	line string
+	line      string
+	minLength int
 }
 
 func (it *credVarsIterator) YieldCred(name, value string) {
+	// The encoded/escaped forms are computed once on the whole secret, since
+	// a multi-line secret (e.g. a PEM key) is base64-encoded or JSON-escaped
+	// as a single unit, not line by line.
+	if len(value) > it.minLength {
+		encoded := base64.StdEncoding.EncodeToString([]byte(value))
+		it.line = strings.Replace(it.line, encoded, "((redacted))", -1)
+
+		if escaped, ok := jsonEscape(value); ok {
+			it.line = strings.Replace(it.line, escaped, "((redacted))", -1)
+		}
+	}
+
 	for _, lineValue := range strings.Split(value, "\n") {
 		lineValue = strings.TrimSpace(lineValue)
-		// Don't consider a single char as a secret.
-		if len(lineValue) > 1 {
-			it.line = strings.Replace(it.line, lineValue, "((redacted))", -1)
+		// Don't consider a value no longer than the configured threshold a secret.
+		if len(lineValue) <= it.minLength {
+			continue
 		}
+
+		it.line = strings.Replace(it.line, lineValue, "((redacted))", -1)
 	}
 }
+
+// jsonEscape returns value as it would appear inside a JSON string, with
+// the surrounding quotes that json.Marshal adds stripped back off.
+func jsonEscape(value string) (string, bool) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+
+	return string(b[1 : len(b)-1]), true
+}
@@ -0,0 +1,56 @@
+package engine
+
+import "testing"
+
+func TestAllowlistAllows(t *testing.T) {
+	allowlist := []EscalationAllowlistEntry{
+		{ImageType: "registry-image", Repository: "concourse/concourse"},
+		{ImageType: "docker-image", Repository: "concourse/static-resource"},
+	}
+
+	cases := []struct {
+		name       string
+		allowlist  []EscalationAllowlistEntry
+		imageType  string
+		repository string
+		want       bool
+	}{
+		{
+			name:       "matching image type and repository",
+			allowlist:  allowlist,
+			imageType:  "registry-image",
+			repository: "concourse/concourse",
+			want:       true,
+		},
+		{
+			name:       "matching repository but wrong image type",
+			allowlist:  allowlist,
+			imageType:  "docker-image",
+			repository: "concourse/concourse",
+			want:       false,
+		},
+		{
+			name:       "matching image type but wrong repository",
+			allowlist:  allowlist,
+			imageType:  "registry-image",
+			repository: "some/other-image",
+			want:       false,
+		},
+		{
+			name:       "no entries on the allowlist",
+			allowlist:  nil,
+			imageType:  "registry-image",
+			repository: "concourse/concourse",
+			want:       false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := allowlistAllows(c.allowlist, c.imageType, c.repository)
+			if got != c.want {
+				t.Errorf("allowlistAllows(%v, %q, %q) = %v, want %v", c.allowlist, c.imageType, c.repository, got, c.want)
+			}
+		})
+	}
+}